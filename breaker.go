@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half_open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitBreaker keeps primary2 failures from reaching the client path:
+// once tripped, handleConn skips dialing primary2 entirely until the
+// breaker judges it healthy again.
+type CircuitBreaker struct {
+	mu sync.Mutex
+
+	failureThreshold int
+	coolDown         time.Duration
+	halfOpenProbes   int
+
+	state               breakerState
+	consecutiveFailures int
+	openedAt            time.Time
+	halfOpenInFlight    int
+	halfOpenSuccesses   int
+}
+
+func NewCircuitBreaker(failureThreshold int, coolDown time.Duration, halfOpenProbes int) *CircuitBreaker {
+	return &CircuitBreaker{
+		failureThreshold: failureThreshold,
+		coolDown:         coolDown,
+		halfOpenProbes:   halfOpenProbes,
+	}
+}
+
+// Allow reports whether a primary2 attempt should be made right now, moving
+// an open breaker into its half-open probing window once coolDown elapses.
+func (b *CircuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.coolDown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.halfOpenInFlight = 0
+		b.halfOpenSuccesses = 0
+		fallthrough
+	case breakerHalfOpen:
+		if b.halfOpenInFlight >= b.halfOpenProbes {
+			return false
+		}
+		b.halfOpenInFlight++
+		return true
+	default: // breakerClosed
+		return true
+	}
+}
+
+// RecordResult reports the outcome of a primary2 dial made after Allow
+// returned true.
+func (b *CircuitBreaker) RecordResult(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerHalfOpen:
+		if success {
+			b.halfOpenSuccesses++
+			if b.halfOpenSuccesses >= b.halfOpenProbes {
+				b.state = breakerClosed
+				b.consecutiveFailures = 0
+			}
+		} else {
+			b.trip()
+		}
+	default: // breakerClosed
+		if success {
+			b.consecutiveFailures = 0
+		} else {
+			b.consecutiveFailures++
+			if b.consecutiveFailures >= b.failureThreshold {
+				b.trip()
+			}
+		}
+	}
+}
+
+// Probe reports the outcome of a background health check, independent of
+// real client traffic. A successful probe opens the half-open window early;
+// a failed one extends the cool-down so a still-broken backend stays skipped.
+func (b *CircuitBreaker) Probe(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != breakerOpen {
+		return
+	}
+	if success {
+		b.state = breakerHalfOpen
+		b.halfOpenInFlight = 0
+		b.halfOpenSuccesses = 0
+	} else {
+		b.openedAt = time.Now()
+	}
+}
+
+func (b *CircuitBreaker) trip() {
+	b.state = breakerOpen
+	b.openedAt = time.Now()
+	b.consecutiveFailures = 0
+}
+
+func (b *CircuitBreaker) State() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+var breakerRegistry = struct {
+	mu       sync.Mutex
+	breakers map[string]*CircuitBreaker
+}{breakers: make(map[string]*CircuitBreaker)}
+
+// getBreaker returns the mapping's circuit breaker, creating it on first use.
+func getBreaker(mapping string, opts Options) *CircuitBreaker {
+	breakerRegistry.mu.Lock()
+	defer breakerRegistry.mu.Unlock()
+	b, ok := breakerRegistry.breakers[mapping]
+	if !ok {
+		b = NewCircuitBreaker(opts.BreakerFailureThreshold, opts.BreakerCoolDown, opts.BreakerHalfOpenProbes)
+		breakerRegistry.breakers[mapping] = b
+	}
+	return b
+}
+
+// healthProbeLoop periodically dials m.Primary2 so an open breaker can
+// recover as soon as the backend is reachable again, rather than waiting
+// for client traffic to retry it.
+func healthProbeLoop(ctx context.Context, m Mapping, opts Options, breaker *CircuitBreaker) {
+	if opts.BreakerProbeInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(opts.BreakerProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if breaker.State() != breakerOpen {
+				continue
+			}
+			conn, err := dial(m.Primary2, opts.Primary2DialTimeout)
+			if err != nil {
+				breaker.Probe(false)
+				continue
+			}
+			conn.Close()
+			breaker.Probe(true)
+		}
+	}
+}
+
+// debugBreakersHandler serves the live state of every mapping's breaker.
+func debugBreakersHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		breakerRegistry.mu.Lock()
+		states := make(map[string]string, len(breakerRegistry.breakers))
+		for mapping, b := range breakerRegistry.breakers {
+			states[mapping] = b.State().String()
+		}
+		breakerRegistry.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(states)
+	})
+}
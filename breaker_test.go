@@ -0,0 +1,143 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerTripsAfterThreshold(t *testing.T) {
+	b := NewCircuitBreaker(3, time.Minute, 1)
+
+	for i := 0; i < 2; i++ {
+		if !b.Allow() {
+			t.Fatalf("Allow() = false before threshold reached")
+		}
+		b.RecordResult(false)
+	}
+	if b.State() != breakerClosed {
+		t.Fatalf("State() = %v, want closed before threshold reached", b.State())
+	}
+
+	if !b.Allow() {
+		t.Fatalf("Allow() = false before threshold reached")
+	}
+	b.RecordResult(false)
+	if b.State() != breakerOpen {
+		t.Fatalf("State() = %v, want open after %d consecutive failures", b.State(), 3)
+	}
+	if b.Allow() {
+		t.Fatalf("Allow() = true immediately after tripping, want false during cool-down")
+	}
+}
+
+func TestCircuitBreakerSuccessResetsFailureCount(t *testing.T) {
+	b := NewCircuitBreaker(3, time.Minute, 1)
+
+	b.Allow()
+	b.RecordResult(false)
+	b.Allow()
+	b.RecordResult(false)
+	b.Allow()
+	b.RecordResult(true) // resets consecutiveFailures
+
+	b.Allow()
+	b.RecordResult(false)
+	b.Allow()
+	b.RecordResult(false)
+	if b.State() != breakerClosed {
+		t.Fatalf("State() = %v, want closed: a success should reset the failure streak", b.State())
+	}
+}
+
+func TestCircuitBreakerHalfOpenClosesAfterProbes(t *testing.T) {
+	b := NewCircuitBreaker(1, 10*time.Millisecond, 2)
+
+	b.Allow()
+	b.RecordResult(false) // trips
+	if b.State() != breakerOpen {
+		t.Fatalf("State() = %v, want open", b.State())
+	}
+
+	time.Sleep(15 * time.Millisecond)
+
+	if !b.Allow() {
+		t.Fatalf("Allow() = false, want true: cool-down elapsed, should enter half-open")
+	}
+	if b.State() != breakerHalfOpen {
+		t.Fatalf("State() = %v, want half_open", b.State())
+	}
+	b.RecordResult(true)
+	if b.State() != breakerHalfOpen {
+		t.Fatalf("State() = %v, want still half_open: only 1 of 2 required probes succeeded", b.State())
+	}
+
+	if !b.Allow() {
+		t.Fatalf("Allow() = false, want true: half-open window should allow a second probe")
+	}
+	b.RecordResult(true)
+	if b.State() != breakerClosed {
+		t.Fatalf("State() = %v, want closed after %d successful half-open probes", b.State(), 2)
+	}
+}
+
+func TestCircuitBreakerHalfOpenFailureReopens(t *testing.T) {
+	b := NewCircuitBreaker(1, 10*time.Millisecond, 1)
+
+	b.Allow()
+	b.RecordResult(false) // trips
+	time.Sleep(15 * time.Millisecond)
+
+	if !b.Allow() {
+		t.Fatalf("Allow() = false, want true: cool-down elapsed, should enter half-open")
+	}
+	b.RecordResult(false) // half-open probe fails
+	if b.State() != breakerOpen {
+		t.Fatalf("State() = %v, want open: a failed half-open probe should re-trip the breaker", b.State())
+	}
+}
+
+func TestCircuitBreakerHalfOpenLimitsConcurrentProbes(t *testing.T) {
+	b := NewCircuitBreaker(1, 10*time.Millisecond, 1)
+
+	b.Allow()
+	b.RecordResult(false) // trips
+	time.Sleep(15 * time.Millisecond)
+
+	if !b.Allow() {
+		t.Fatalf("Allow() = false, want true for the first half-open probe")
+	}
+	if b.Allow() {
+		t.Fatalf("Allow() = true, want false: halfOpenProbes=1 already has a probe in flight")
+	}
+}
+
+func TestCircuitBreakerProbeOpensHalfOpenEarly(t *testing.T) {
+	b := NewCircuitBreaker(1, time.Hour, 1)
+
+	b.Allow()
+	b.RecordResult(false) // trips, cool-down is long
+	if b.Allow() {
+		t.Fatalf("Allow() = true during cool-down, want false")
+	}
+
+	b.Probe(true)
+	if b.State() != breakerHalfOpen {
+		t.Fatalf("State() = %v, want half_open: a successful background probe should open the half-open window early", b.State())
+	}
+	if !b.Allow() {
+		t.Fatalf("Allow() = false, want true once Probe(true) has moved the breaker to half-open")
+	}
+}
+
+func TestCircuitBreakerProbeFailureExtendsCoolDown(t *testing.T) {
+	b := NewCircuitBreaker(1, 10*time.Millisecond, 1)
+
+	b.Allow()
+	b.RecordResult(false) // trips
+	time.Sleep(15 * time.Millisecond)
+
+	b.Probe(false) // extends the cool-down from now
+	if b.Allow() {
+		t.Fatalf("Allow() = true, want false: Probe(false) should restart the cool-down window")
+	}
+}
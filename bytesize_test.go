@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestByteSizeSet(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    byteSize
+		wantErr bool
+	}{
+		{"1024", 1024, false},
+		{"0", 0, false},
+		{"4KiB", 4 << 10, false},
+		{"4MiB", 4 << 20, false},
+		{"2GiB", 2 << 30, false},
+		{"4KB", 4000, false},
+		{"4MB", 4000000, false},
+		{"2GB", 2000000000, false},
+		{"10B", 10, false},
+		{" 4MiB ", 4 << 20, false},
+		{"bogus", 0, true},
+		{"MiB", 0, true},
+	}
+	for _, tt := range tests {
+		var b byteSize
+		err := b.Set(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Set(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && b != tt.want {
+			t.Errorf("Set(%q) = %d, want %d", tt.in, b, tt.want)
+		}
+	}
+}
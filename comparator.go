@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ComparatorPolicy selects how a primary2 response is diffed against
+// primary1's before being reported, rather than just discarded.
+type ComparatorPolicy string
+
+const (
+	ComparatorNone   ComparatorPolicy = ""
+	ComparatorBytes  ComparatorPolicy = "bytes"
+	ComparatorLine   ComparatorPolicy = "line"
+	ComparatorHTTP   ComparatorPolicy = "http"
+	ComparatorCustom ComparatorPolicy = "custom"
+)
+
+func parseComparatorPolicy(s string) (ComparatorPolicy, error) {
+	switch ComparatorPolicy(s) {
+	case ComparatorCustom:
+		if customComparator == nil {
+			return "", fmt.Errorf("-compare=custom requires a comparator registered via RegisterComparator")
+		}
+		return ComparatorCustom, nil
+	case ComparatorNone, ComparatorBytes, ComparatorLine, ComparatorHTTP:
+		return ComparatorPolicy(s), nil
+	default:
+		return "", fmt.Errorf("unknown -compare policy %q", s)
+	}
+}
+
+// HTTPHeaderIgnore lists response headers excluded from HTTP-mode comparison
+// because they legitimately differ between otherwise-identical responses.
+var HTTPHeaderIgnore = []string{"Date", "Server", "X-Request-Id"}
+
+// HTTPComparison holds the result of comparing two HTTP responses.
+type HTTPComparison struct {
+	StatusMatch bool `json:"status_match"`
+	HeaderMatch bool `json:"header_match"`
+	BodyMatch   bool `json:"body_match"`
+	Status1     int  `json:"status1"`
+	Status2     int  `json:"status2"`
+}
+
+// ComparisonRecord is the structured report produced per request when
+// shadow-response comparison is enabled.
+type ComparisonRecord struct {
+	Mapping         string `json:"mapping"`
+	ClientAddr      string `json:"client_addr"`
+	BytesUpstream   int64  `json:"bytes_upstream"`
+	ByteDiff        int64  `json:"byte_diff"`
+	FirstDiffOffset int64  `json:"first_diff_offset"` // -1 if no diff found
+	Match           bool   `json:"match"`
+	// Primary1Overflow and Primary2Overflow count bytes each leg dropped past
+	// -compare-max-buffer. A non-zero value means Match only reflects the
+	// buffered prefix, not the full (untruncated) response.
+	Primary1Overflow int64           `json:"primary1_overflow,omitempty"`
+	Primary2Overflow int64           `json:"primary2_overflow,omitempty"`
+	HTTP             *HTTPComparison `json:"http,omitempty"`
+}
+
+// Reporter publishes ComparisonRecords. Callers pass every record unsampled;
+// the Reporter from newReporter drops matches and samples mismatches itself.
+type Reporter interface {
+	Report(rec ComparisonRecord)
+}
+
+// jsonReporter writes one JSON record per line, rate-limited per mapping so
+// a consistently-mismatching mapping doesn't flood the log.
+type jsonReporter struct {
+	enc *json.Encoder
+
+	mu      sync.Mutex
+	limiter map[string]*sampler
+	rate    int
+}
+
+func newReporter(w io.Writer, sampleRate int) Reporter {
+	return &jsonReporter{
+		enc:     json.NewEncoder(w),
+		limiter: make(map[string]*sampler),
+		rate:    sampleRate,
+	}
+}
+
+func (r *jsonReporter) Report(rec ComparisonRecord) {
+	if rec.Match {
+		return
+	}
+	r.mu.Lock()
+	s, ok := r.limiter[rec.Mapping]
+	if !ok {
+		s = &sampler{ratePerMinute: r.rate}
+		r.limiter[rec.Mapping] = s
+	}
+	allow := s.allow()
+	r.mu.Unlock()
+	if !allow {
+		return
+	}
+	_ = r.enc.Encode(rec)
+}
+
+// sampler is a minimal fixed-window rate limiter: at most ratePerMinute
+// Report calls per mapping are allowed to actually write, the rest are
+// dropped so a flapping shadow backend can't flood the log.
+type sampler struct {
+	ratePerMinute int
+	windowStart   time.Time
+	count         int
+}
+
+func (s *sampler) allow() bool {
+	now := time.Now()
+	if s.windowStart.IsZero() || now.Sub(s.windowStart) >= time.Minute {
+		s.windowStart = now
+		s.count = 0
+	}
+	if s.count >= s.ratePerMinute {
+		return false
+	}
+	s.count++
+	return true
+}
+
+// limitedBuffer is a bytes.Buffer capped at max bytes; writes beyond the cap
+// are still counted (via overflow) but not retained, bounding memory use for
+// large or streaming responses.
+type limitedBuffer struct {
+	buf      bytes.Buffer
+	max      int64
+	overflow int64
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	room := b.max - int64(b.buf.Len())
+	if room > 0 {
+		if int64(len(p)) > room {
+			b.buf.Write(p[:room])
+			b.overflow += int64(len(p)) - room
+		} else {
+			b.buf.Write(p)
+		}
+	} else {
+		b.overflow += int64(len(p))
+	}
+	return n, nil
+}
+
+// comparison buffers both legs' responses for a single request so they can
+// be diffed once both copies finish.
+type comparison struct {
+	policy   ComparatorPolicy
+	primary1 *limitedBuffer
+	primary2 *limitedBuffer
+}
+
+func newComparison(policy ComparatorPolicy, maxBuffer int64) *comparison {
+	return &comparison{
+		policy:   policy,
+		primary1: &limitedBuffer{max: maxBuffer},
+		primary2: &limitedBuffer{max: maxBuffer},
+	}
+}
+
+func (c *comparison) compare(rec ComparisonRecord) ComparisonRecord {
+	b1 := c.primary1.buf.Bytes()
+	b2 := c.primary2.buf.Bytes()
+
+	rec.ByteDiff = int64(len(b2)) - int64(len(b1))
+	rec.FirstDiffOffset = firstDiffOffset(b1, b2)
+	rec.Match = rec.FirstDiffOffset < 0 && rec.ByteDiff == 0
+	rec.Primary1Overflow = c.primary1.overflow
+	rec.Primary2Overflow = c.primary2.overflow
+
+	switch c.policy {
+	case ComparatorHTTP:
+		httpCmp := compareHTTP(b1, b2)
+		rec.HTTP = &httpCmp
+		rec.Match = httpCmp.StatusMatch && httpCmp.HeaderMatch && httpCmp.BodyMatch
+	case ComparatorLine:
+		rec.Match = bytes.Equal(bytes.TrimRight(b1, "\n"), bytes.TrimRight(b2, "\n"))
+	case ComparatorCustom:
+		rec.Match = customComparator(b1, b2)
+	}
+	return rec
+}
+
+// CompareFunc implements shadow-response comparison logic for -compare=custom.
+// It receives primary1's and primary2's buffered response bytes (each
+// truncated at -compare-max-buffer) and reports whether they match.
+type CompareFunc func(primary1, primary2 []byte) bool
+
+// customComparator holds the function registered for -compare=custom. It
+// must be installed with RegisterComparator before flag.Parse runs.
+var customComparator CompareFunc
+
+// RegisterComparator installs fn as the comparison logic used when
+// -compare=custom is selected. Embedders that need comparison logic beyond
+// "bytes"/"line"/"http" call this from an init func; parseComparatorPolicy
+// rejects "custom" if nothing has been registered.
+func RegisterComparator(fn CompareFunc) {
+	customComparator = fn
+}
+
+// firstDiffOffset returns the index of the first byte that differs between
+// a and b, or the length of the shorter one if it is a prefix of the longer.
+// It returns -1 only when a and b are equal.
+func firstDiffOffset(a, b []byte) int64 {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return int64(i)
+		}
+	}
+	if len(a) != len(b) {
+		return int64(n)
+	}
+	return -1
+}
+
+func compareHTTP(b1, b2 []byte) HTTPComparison {
+	var out HTTPComparison
+
+	r1, err1 := http.ReadResponse(bufio.NewReader(bytes.NewReader(b1)), nil)
+	r2, err2 := http.ReadResponse(bufio.NewReader(bytes.NewReader(b2)), nil)
+	if err1 != nil || err2 != nil {
+		return out
+	}
+	defer r1.Body.Close()
+	defer r2.Body.Close()
+
+	out.Status1, out.Status2 = r1.StatusCode, r2.StatusCode
+	out.StatusMatch = r1.StatusCode == r2.StatusCode
+	out.HeaderMatch = headersEqual(r1.Header, r2.Header, HTTPHeaderIgnore)
+
+	body1, _ := io.ReadAll(r1.Body)
+	body2, _ := io.ReadAll(r2.Body)
+	out.BodyMatch = bytes.Equal(body1, body2)
+	return out
+}
+
+func headersEqual(h1, h2 http.Header, ignore []string) bool {
+	skip := make(map[string]bool, len(ignore))
+	for _, k := range ignore {
+		skip[http.CanonicalHeaderKey(k)] = true
+	}
+	eq := func(a, b http.Header) bool {
+		for k, v := range a {
+			if skip[k] {
+				continue
+			}
+			if !equalStrings(v, b[k]) {
+				return false
+			}
+		}
+		return true
+	}
+	return eq(h1, h2) && eq(h2, h1)
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFirstDiffOffset(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []byte
+		want int64
+	}{
+		{"equal", []byte("hello"), []byte("hello"), -1},
+		{"a prefix of b", []byte("hell"), []byte("hello"), 4},
+		{"b prefix of a", []byte("hello"), []byte("hell"), 4},
+		{"differ at start", []byte("hello"), []byte("jello"), 0},
+		{"differ in middle", []byte("hello"), []byte("hXllo"), 1},
+		{"both empty", []byte{}, []byte{}, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := firstDiffOffset(tt.a, tt.b); got != tt.want {
+				t.Errorf("firstDiffOffset(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimitedBufferOverflow(t *testing.T) {
+	b := &limitedBuffer{max: 4}
+
+	n, err := b.Write([]byte("ab"))
+	if err != nil || n != 2 {
+		t.Fatalf("Write() = (%d, %v), want (2, nil)", n, err)
+	}
+	if b.overflow != 0 {
+		t.Fatalf("overflow = %d, want 0 before max is reached", b.overflow)
+	}
+
+	n, err = b.Write([]byte("cdef")) // 2 fit, 2 overflow
+	if err != nil || n != 4 {
+		t.Fatalf("Write() = (%d, %v), want (4, nil)", n, err)
+	}
+	if got, want := b.overflow, int64(2); got != want {
+		t.Fatalf("overflow = %d, want %d", got, want)
+	}
+	if got, want := b.buf.String(), "abcd"; got != want {
+		t.Fatalf("buf = %q, want %q", got, want)
+	}
+
+	n, err = b.Write([]byte("gh")) // buffer already full, all overflow
+	if err != nil || n != 2 {
+		t.Fatalf("Write() = (%d, %v), want (2, nil)", n, err)
+	}
+	if got, want := b.overflow, int64(4); got != want {
+		t.Fatalf("overflow = %d, want %d", got, want)
+	}
+}
+
+func TestSamplerAllowWindowing(t *testing.T) {
+	s := &sampler{ratePerMinute: 2}
+
+	if !s.allow() {
+		t.Fatalf("allow() = false, want true for the 1st call in a fresh window")
+	}
+	if !s.allow() {
+		t.Fatalf("allow() = false, want true for the 2nd call, at the rate limit")
+	}
+	if s.allow() {
+		t.Fatalf("allow() = true, want false: 3rd call exceeds ratePerMinute within the window")
+	}
+
+	s.windowStart = time.Now().Add(-time.Minute - time.Second)
+	if !s.allow() {
+		t.Fatalf("allow() = false, want true once the window has elapsed and reset")
+	}
+	if got, want := s.count, 1; got != want {
+		t.Fatalf("count = %d, want %d: a new window should reset the counter", got, want)
+	}
+}
+
+func TestHeadersEqual(t *testing.T) {
+	base := http.Header{
+		"Date":         []string{"Mon, 01 Jan 2024 00:00:00 GMT"},
+		"Content-Type": []string{"text/plain"},
+	}
+	other := http.Header{
+		"Date":         []string{"Tue, 02 Jan 2024 00:00:00 GMT"},
+		"Content-Type": []string{"text/plain"},
+	}
+	if !headersEqual(base, other, HTTPHeaderIgnore) {
+		t.Fatalf("headersEqual() = false, want true: only an ignored header (Date) differs")
+	}
+
+	other["Content-Type"] = []string{"application/json"}
+	if headersEqual(base, other, HTTPHeaderIgnore) {
+		t.Fatalf("headersEqual() = true, want false: a non-ignored header (Content-Type) differs")
+	}
+}
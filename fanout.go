@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// OverflowPolicy decides what a sink does when its buffer is full.
+type OverflowPolicy string
+
+const (
+	OverflowBlock          OverflowPolicy = "block"
+	OverflowDropNewest     OverflowPolicy = "drop-newest"
+	OverflowDropOldest     OverflowPolicy = "drop-oldest"
+	OverflowDisconnectSink OverflowPolicy = "disconnect-sink"
+)
+
+func parseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch OverflowPolicy(s) {
+	case OverflowBlock, OverflowDropNewest, OverflowDropOldest, OverflowDisconnectSink:
+		return OverflowPolicy(s), nil
+	default:
+		return "", fmt.Errorf("unknown overflow policy %q", s)
+	}
+}
+
+// fanoutChunkSize is the read buffer size used by fanOutCopy, and newSink
+// divides a sink's byte buffer by it to size the sink's channel.
+const fanoutChunkSize = 32 * 1024
+
+// sink is one fan-out destination with its own writer goroutine and
+// backpressure policy. A slow or wedged sink does not stall the others,
+// except under OverflowBlock: a full block sink holds up publish until it drains.
+type sink struct {
+	name     string
+	w        io.Writer
+	overflow OverflowPolicy
+
+	ch           chan []byte
+	dropped      int64 // atomic: bytes dropped due to overflow or after a write error
+	disconnected int32 // atomic bool: true once closed for writing
+
+	wg *sync.WaitGroup
+}
+
+func newSink(name string, w io.Writer, bufferBytes int64, overflow OverflowPolicy) *sink {
+	capacity := bufferBytes / fanoutChunkSize
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &sink{
+		name:     name,
+		w:        w,
+		overflow: overflow,
+		ch:       make(chan []byte, capacity),
+	}
+}
+
+// run drains the sink's channel into its writer until the channel is closed.
+// It stops writing (but keeps draining, to avoid blocking publishers) once
+// the underlying writer errors.
+func (s *sink) run(wg *sync.WaitGroup) {
+	defer wg.Done()
+	failed := false
+	for chunk := range s.ch {
+		if failed {
+			atomic.AddInt64(&s.dropped, int64(len(chunk)))
+			continue
+		}
+		if _, err := s.w.Write(chunk); err != nil {
+			failed = true
+			atomic.StoreInt32(&s.disconnected, 1)
+		}
+	}
+}
+
+// publish delivers chunk to the sink according to its overflow policy. It
+// never blocks the caller for longer than the policy allows.
+func (s *sink) publish(chunk []byte) {
+	if atomic.LoadInt32(&s.disconnected) == 1 {
+		atomic.AddInt64(&s.dropped, int64(len(chunk)))
+		return
+	}
+
+	switch s.overflow {
+	case OverflowBlock:
+		s.ch <- chunk
+
+	case OverflowDropNewest:
+		select {
+		case s.ch <- chunk:
+		default:
+			atomic.AddInt64(&s.dropped, int64(len(chunk)))
+		}
+
+	case OverflowDropOldest:
+		for {
+			select {
+			case s.ch <- chunk:
+				return
+			default:
+			}
+			select {
+			case old := <-s.ch:
+				atomic.AddInt64(&s.dropped, int64(len(old)))
+			default:
+				// Raced with the sink goroutine draining a slot; retry.
+			}
+		}
+
+	case OverflowDisconnectSink:
+		select {
+		case s.ch <- chunk:
+		default:
+			atomic.StoreInt32(&s.disconnected, 1)
+			atomic.AddInt64(&s.dropped, int64(len(chunk)))
+		}
+	}
+}
+
+func (s *sink) droppedBytes() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+// fanOutCopy reads from src and publishes each chunk to every sink
+// independently, so a stalled or overflowing sink cannot hold up the
+// others or the read loop itself, unless its policy is OverflowBlock, in
+// which case a full sink blocks the read loop. It returns the total bytes
+// read from src.
+func fanOutCopy(src io.Reader, sinks ...*sink) int64 {
+	var wg sync.WaitGroup
+	wg.Add(len(sinks))
+	for _, s := range sinks {
+		go s.run(&wg)
+	}
+
+	var total int64
+	buf := make([]byte, fanoutChunkSize)
+	for {
+		n, rerr := src.Read(buf)
+		if n > 0 {
+			chunk := make([]byte, n)
+			copy(chunk, buf[:n])
+			for _, s := range sinks {
+				s.publish(chunk)
+			}
+			total += int64(n)
+		}
+		if rerr != nil {
+			break
+		}
+	}
+
+	for _, s := range sinks {
+		close(s.ch)
+	}
+	wg.Wait()
+	return total
+}
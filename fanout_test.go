@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+)
+
+func TestParseOverflowPolicy(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    OverflowPolicy
+		wantErr bool
+	}{
+		{"block", OverflowBlock, false},
+		{"drop-newest", OverflowDropNewest, false},
+		{"drop-oldest", OverflowDropOldest, false},
+		{"disconnect-sink", OverflowDisconnectSink, false},
+		{"bogus", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseOverflowPolicy(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseOverflowPolicy(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseOverflowPolicy(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// These exercise sink.publish directly, without a consumer draining s.ch, so
+// the buffered channel's capacity deterministically decides when each
+// overflow policy kicks in.
+
+func TestSinkDropNewestDropsArrivingChunk(t *testing.T) {
+	s := newSink("p2", io.Discard, fanoutChunkSize, OverflowDropNewest)
+	chunk1 := bytes.Repeat([]byte("a"), fanoutChunkSize)
+	chunk2 := bytes.Repeat([]byte("b"), fanoutChunkSize)
+
+	s.publish(chunk1) // fills the 1-slot channel
+	s.publish(chunk2) // channel full, arriving chunk should be dropped
+
+	if got, want := s.droppedBytes(), int64(len(chunk2)); got != want {
+		t.Fatalf("droppedBytes() = %d, want %d", got, want)
+	}
+}
+
+func TestSinkDropOldestDropsQueuedChunk(t *testing.T) {
+	s := newSink("p2", io.Discard, fanoutChunkSize, OverflowDropOldest)
+	chunk1 := bytes.Repeat([]byte("a"), fanoutChunkSize)
+	chunk2 := bytes.Repeat([]byte("b"), fanoutChunkSize)
+
+	s.publish(chunk1) // fills the 1-slot channel
+	s.publish(chunk2) // must evict chunk1 to make room
+
+	if got, want := s.droppedBytes(), int64(len(chunk1)); got != want {
+		t.Fatalf("droppedBytes() = %d, want %d (the evicted queued chunk)", got, want)
+	}
+}
+
+func TestSinkDisconnectDropsEverythingAfterOverflow(t *testing.T) {
+	s := newSink("p2", io.Discard, fanoutChunkSize, OverflowDisconnectSink)
+	chunk1 := bytes.Repeat([]byte("a"), fanoutChunkSize)
+	chunk2 := bytes.Repeat([]byte("b"), fanoutChunkSize)
+	chunk3 := bytes.Repeat([]byte("c"), fanoutChunkSize)
+
+	s.publish(chunk1) // fills the 1-slot channel
+	s.publish(chunk2) // overflows, disconnects the sink
+	s.publish(chunk3) // sink already disconnected
+
+	if got, want := s.droppedBytes(), int64(len(chunk2)+len(chunk3)); got != want {
+		t.Fatalf("droppedBytes() = %d, want %d", got, want)
+	}
+}
+
+func TestFanOutCopyDeliversToEachSinkIndependently(t *testing.T) {
+	data := []byte("hello, fan-out")
+	var buf1, buf2 bytes.Buffer
+	s1 := newSink("primary1", &buf1, 0, OverflowBlock)
+	s2 := newSink("primary2", &buf2, 0, OverflowBlock)
+
+	n := fanOutCopy(bytes.NewReader(data), s1, s2)
+
+	if n != int64(len(data)) {
+		t.Fatalf("fanOutCopy() = %d, want %d", n, len(data))
+	}
+	if buf1.String() != string(data) || buf2.String() != string(data) {
+		t.Fatalf("sinks got %q / %q, want both %q", buf1.String(), buf2.String(), data)
+	}
+}
+
+func TestSinkRunStopsWritingAfterError(t *testing.T) {
+	w := &failingWriter{}
+	s := newSink("p2", w, 0, OverflowBlock)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go s.run(&wg)
+
+	s.publish([]byte("a"))
+	s.publish([]byte("b"))
+	close(s.ch)
+	wg.Wait()
+
+	if w.writes != 1 {
+		t.Fatalf("writes = %d, want 1: run should stop calling Write once one fails", w.writes)
+	}
+}
+
+func TestSinkRunDropsQueuedChunksAfterError(t *testing.T) {
+	w := &failingWriter{}
+	s := newSink("p2", w, 0, OverflowBlock)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go s.run(&wg)
+
+	chunk := bytes.Repeat([]byte("a"), 10)
+	for i := 0; i < 4; i++ {
+		s.publish(chunk)
+	}
+	close(s.ch)
+	wg.Wait()
+
+	if got, want := s.droppedBytes(), int64(3*len(chunk)); got != want {
+		t.Fatalf("droppedBytes() = %d, want %d: the 3 chunks queued after the first write failed should count as dropped", got, want)
+	}
+}
+
+type failingWriter struct {
+	writes int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return 0, bytes.ErrTooLarge
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Field is one structured key/value pair attached to a log event.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+func F(key string, value interface{}) Field { return Field{Key: key, Value: value} }
+
+// Logger replaces the ad-hoc log.Printf calls in serve/handleConn with
+// structured events carrying mapping/client_addr/primary1/primary2 context.
+type Logger interface {
+	Log(event string, fields ...Field)
+}
+
+func parseLogSink(sink, file string, maxSizeMB, maxAgeDays, maxBackups int) (Logger, error) {
+	switch sink {
+	case "", "console":
+		return &consoleLogger{out: log.New(os.Stderr, "", log.LstdFlags)}, nil
+	case "json":
+		return &jsonLogger{enc: json.NewEncoder(os.Stderr)}, nil
+	case "filesystem":
+		if file == "" {
+			return nil, fmt.Errorf("log-sink=filesystem requires -log-file")
+		}
+		w := &rotatingFile{
+			path:       file,
+			maxBytes:   int64(maxSizeMB) << 20,
+			maxAge:     time.Duration(maxAgeDays) * 24 * time.Hour,
+			maxBackups: maxBackups,
+		}
+		return &jsonLogger{enc: json.NewEncoder(w)}, nil
+	default:
+		return nil, fmt.Errorf("unknown -log-sink %q", sink)
+	}
+}
+
+// consoleLogger renders events as a single human-readable line, matching
+// the repo's original log.Printf style.
+type consoleLogger struct {
+	out *log.Logger
+}
+
+func (c *consoleLogger) Log(event string, fields ...Field) {
+	var b strings.Builder
+	b.WriteString(event)
+	for _, f := range fields {
+		fmt.Fprintf(&b, " %s=%v", f.Key, f.Value)
+	}
+	c.out.Print(b.String())
+}
+
+// jsonLogger writes one JSON object per line, sorted by key for stable
+// diffs, with "event" and "time" alongside the caller's fields.
+type jsonLogger struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func (j *jsonLogger) Log(event string, fields ...Field) {
+	rec := make(map[string]interface{}, len(fields)+2)
+	rec["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	rec["event"] = event
+	for _, f := range fields {
+		rec[f.Key] = f.Value
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_ = j.enc.Encode(rec)
+}
+
+// rotatingFile is an io.Writer over a path that rolls over once maxBytes is
+// exceeded, keeping at most maxBackups old files no older than maxAge.
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxBytes   int64
+	maxAge     time.Duration
+	maxBackups int
+
+	f    *os.File
+	size int64
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	if r.maxBytes > 0 && r.size+int64(len(p)) > r.maxBytes {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = fi.Size()
+	return nil
+}
+
+func (r *rotatingFile) rotate() error {
+	if r.f != nil {
+		r.f.Close()
+		r.f = nil
+	}
+	backup := fmt.Sprintf("%s.%s", r.path, time.Now().UTC().Format("20060102T150405.000000000"))
+	if err := os.Rename(r.path, backup); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	r.pruneBackups()
+	return r.open()
+}
+
+func (r *rotatingFile) pruneBackups() {
+	matches, err := filepath.Glob(r.path + ".*")
+	if err != nil {
+		return
+	}
+	sort.Strings(matches) // timestamp suffix sorts chronologically
+	cutoff := time.Now().Add(-r.maxAge)
+	var kept []string
+	for _, m := range matches {
+		if r.maxAge > 0 {
+			if fi, err := os.Stat(m); err == nil && fi.ModTime().Before(cutoff) {
+				os.Remove(m)
+				continue
+			}
+		}
+		kept = append(kept, m)
+	}
+	if r.maxBackups > 0 && len(kept) > r.maxBackups {
+		for _, m := range kept[:len(kept)-r.maxBackups] {
+			os.Remove(m)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRotatingFileRotatesPastMaxBytes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tee.log")
+	r := &rotatingFile{path: path, maxBytes: 4}
+
+	if _, err := r.Write([]byte("ab")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if _, err := r.Write([]byte("cdef")); err != nil { // 2+4 > 4, must rotate first
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatalf("Glob() error = %v", err)
+	}
+	if len(matches) != 1 {
+		t.Fatalf("backups = %d, want 1 after crossing maxBytes once", len(matches))
+	}
+	backup, err := os.ReadFile(matches[0])
+	if err != nil {
+		t.Fatalf("ReadFile(backup) error = %v", err)
+	}
+	if string(backup) != "ab" {
+		t.Fatalf("backup contents = %q, want %q", backup, "ab")
+	}
+	cur, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile(current) error = %v", err)
+	}
+	if string(cur) != "cdef" {
+		t.Fatalf("current contents = %q, want %q", cur, "cdef")
+	}
+}
+
+func TestPruneBackupsByMaxBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tee.log")
+	suffixes := []string{"1", "2", "3", "4"}
+	for _, s := range suffixes {
+		if err := os.WriteFile(path+"."+s, []byte("x"), 0o644); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+	}
+
+	r := &rotatingFile{path: path, maxBackups: 2}
+	r.pruneBackups()
+
+	matches, _ := filepath.Glob(path + ".*")
+	if len(matches) != 2 {
+		t.Fatalf("backups = %d, want 2 after pruning to maxBackups", len(matches))
+	}
+	want := map[string]bool{path + ".3": true, path + ".4": true}
+	for _, m := range matches {
+		if !want[m] {
+			t.Fatalf("kept backup %q, want only the 2 newest (%v)", m, want)
+		}
+	}
+}
+
+func TestPruneBackupsByMaxAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tee.log")
+	old := path + ".old"
+	fresh := path + ".fresh"
+	for _, p := range []string{old, fresh} {
+		if err := os.WriteFile(p, []byte("x"), 0o644); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+	}
+	now := time.Now()
+	if err := os.Chtimes(old, now, now.Add(-48*time.Hour)); err != nil {
+		t.Fatalf("Chtimes() error = %v", err)
+	}
+	if err := os.Chtimes(fresh, now, now.Add(-1*time.Hour)); err != nil {
+		t.Fatalf("Chtimes() error = %v", err)
+	}
+
+	r := &rotatingFile{path: path, maxAge: 24 * time.Hour}
+	r.pruneBackups()
+
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Fatalf("backup older than maxAge still exists, want it pruned")
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Fatalf("backup within maxAge was pruned, want it kept: %v", err)
+	}
+}
@@ -0,0 +1,257 @@
+// Package metrics exposes tcp-tee's runtime counters in the Prometheus text
+// exposition format, with no dependency on the official client library.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// labelKey joins label values into a stable map key; order must match the
+// label names declared alongside each metric below.
+func labelKey(values ...string) string {
+	return strings.Join(values, "\x1f")
+}
+
+type counterVec struct {
+	mu     sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]*int64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]*int64)}
+}
+
+func (c *counterVec) Add(n int64, labelValues ...string) {
+	key := labelKey(labelValues...)
+	c.mu.Lock()
+	p, ok := c.values[key]
+	if !ok {
+		var v int64
+		p = &v
+		c.values[key] = p
+	}
+	c.mu.Unlock()
+	atomic.AddInt64(p, n)
+}
+
+func (c *counterVec) Inc(labelValues ...string) { c.Add(1, labelValues...) }
+
+func (c *counterVec) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	c.mu.Lock()
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := atomic.LoadInt64(c.values[k])
+		fmt.Fprintf(w, "%s{%s} %d\n", c.name, labelsString(c.labels, k), v)
+	}
+	c.mu.Unlock()
+}
+
+type gaugeVec struct {
+	mu     sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]*int64
+}
+
+func newGaugeVec(name, help string, labels ...string) *gaugeVec {
+	return &gaugeVec{name: name, help: help, labels: labels, values: make(map[string]*int64)}
+}
+
+func (g *gaugeVec) Add(n int64, labelValues ...string) {
+	key := labelKey(labelValues...)
+	g.mu.Lock()
+	p, ok := g.values[key]
+	if !ok {
+		var v int64
+		p = &v
+		g.values[key] = p
+	}
+	g.mu.Unlock()
+	atomic.AddInt64(p, n)
+}
+
+func (g *gaugeVec) Inc(labelValues ...string) { g.Add(1, labelValues...) }
+func (g *gaugeVec) Dec(labelValues ...string) { g.Add(-1, labelValues...) }
+
+func (g *gaugeVec) Set(n int64, labelValues ...string) {
+	key := labelKey(labelValues...)
+	g.mu.Lock()
+	p, ok := g.values[key]
+	if !ok {
+		var v int64
+		p = &v
+		g.values[key] = p
+	}
+	g.mu.Unlock()
+	atomic.StoreInt64(p, n)
+}
+
+func (g *gaugeVec) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	g.mu.Lock()
+	keys := make([]string, 0, len(g.values))
+	for k := range g.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := atomic.LoadInt64(g.values[k])
+		fmt.Fprintf(w, "%s{%s} %d\n", g.name, labelsString(g.labels, k), v)
+	}
+	g.mu.Unlock()
+}
+
+// histogramVec buckets observations the way client_golang's Histogram does:
+// cumulative per-bucket counts, plus a running sum and total count.
+type histogramVec struct {
+	mu      sync.Mutex
+	name    string
+	help    string
+	labels  string
+	buckets []float64
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []int64
+	sum    float64
+	count  int64
+}
+
+var defaultDurationBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+func newHistogramVec(name, help, labelName string) *histogramVec {
+	return &histogramVec{
+		name:    name,
+		help:    help,
+		labels:  labelName,
+		buckets: defaultDurationBuckets,
+		series:  make(map[string]*histogramSeries),
+	}
+}
+
+func (h *histogramVec) Observe(seconds float64, labelValue string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[labelValue]
+	if !ok {
+		s = &histogramSeries{counts: make([]int64, len(h.buckets))}
+		h.series[labelValue] = s
+	}
+	for i, b := range h.buckets {
+		if seconds <= b {
+			s.counts[i]++
+		}
+	}
+	s.sum += seconds
+	s.count++
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	h.mu.Lock()
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := h.series[k]
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{%s=%q,le=%q} %d\n", h.name, h.labels, k, fmt.Sprintf("%g", b), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s=%q,le=\"+Inf\"} %d\n", h.name, h.labels, k, s.count)
+		fmt.Fprintf(w, "%s_sum{%s=%q} %g\n", h.name, h.labels, k, s.sum)
+		fmt.Fprintf(w, "%s_count{%s=%q} %d\n", h.name, h.labels, k, s.count)
+	}
+	h.mu.Unlock()
+}
+
+func labelsString(names []string, key string) string {
+	values := strings.Split(key, "\x1f")
+	parts := make([]string, len(names))
+	for i, n := range names {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		parts[i] = fmt.Sprintf("%s=%q", n, v)
+	}
+	return strings.Join(parts, ",")
+}
+
+var (
+	bytesTransferred = newCounterVec("bytes_client_to_primary", "Bytes copied between the client and a primary, by direction and leg.", "direction", "leg")
+	dialErrors       = newCounterVec("primary_dial_errors_total", "Dial failures towards a primary leg.", "leg")
+	primary2Drops    = newCounterVec("primary2_write_drops_total", "Bytes dropped on the primary2 leg due to its overflow policy.", "mapping")
+	primary2Skipped  = newCounterVec("primary2_breaker_skipped_bytes_total", "Bytes not sent to primary2 because its circuit breaker was open.", "mapping")
+	activeConns      = newGaugeVec("active_connections", "Client connections currently being handled, by mapping.", "mapping")
+	breakerState     = newGaugeVec("primary2_breaker_state", "Primary2 circuit breaker state by mapping (0=closed, 1=open, 2=half_open).", "mapping")
+	handleDuration   = newHistogramVec("handle_duration_seconds", "Wall-clock duration of a handled connection.", "mapping")
+)
+
+// BytesTransferred records n bytes copied in the given direction ("upstream"
+// or "downstream") to or from the given leg ("primary1" or "primary2").
+func BytesTransferred(direction, leg string, n int64) {
+	bytesTransferred.Add(n, direction, leg)
+}
+
+// DialError records a failed dial attempt towards the given leg.
+func DialError(leg string) {
+	dialErrors.Inc(leg)
+}
+
+// Primary2WriteDrop records n bytes dropped on mapping's primary2 leg.
+func Primary2WriteDrop(mapping string, n int64) {
+	primary2Drops.Add(n, mapping)
+}
+
+// ConnOpened/ConnClosed track the active_connections gauge for a mapping.
+func ConnOpened(mapping string) { activeConns.Inc(mapping) }
+func ConnClosed(mapping string) { activeConns.Dec(mapping) }
+
+// Primary2Skipped records n bytes that bypassed primary2 because its
+// circuit breaker was open.
+func Primary2Skipped(mapping string, n int64) {
+	primary2Skipped.Add(n, mapping)
+}
+
+// SetBreakerState records the primary2 circuit breaker state for a mapping
+// (0=closed, 1=open, 2=half_open).
+func SetBreakerState(mapping string, state int) {
+	breakerState.Set(int64(state), mapping)
+}
+
+// ObserveHandleDuration records how long a handled connection was open.
+func ObserveHandleDuration(mapping string, seconds float64) {
+	handleDuration.Observe(seconds, mapping)
+}
+
+// Handler serves all registered metrics in Prometheus text exposition format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		bytesTransferred.writeTo(w)
+		dialErrors.writeTo(w)
+		primary2Drops.writeTo(w)
+		primary2Skipped.writeTo(w)
+		activeConns.writeTo(w)
+		breakerState.writeTo(w)
+		handleDuration.writeTo(w)
+	})
+}
@@ -0,0 +1,48 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST from linux/netfilter_ipv4.h, reused by
+// ip6tables as IP6T_SO_ORIGINAL_DST. Go's syscall package has no typed
+// getsockopt for either, so we borrow GetsockoptIPv6Mreq/GetsockoptIPv6MTUInfo
+// purely for their raw-byte layout.
+const soOriginalDst = 80
+
+// getOriginalDst reads the pre-DNAT destination of a connection accepted
+// behind an iptables/ip6tables REDIRECT or TPROXY rule.
+func getOriginalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	f, err := conn.File()
+	if err != nil {
+		return nil, fmt.Errorf("dup conn fd: %w", err)
+	}
+	defer f.Close()
+	fd := int(f.Fd())
+
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok && local.IP.To4() == nil {
+		info, err := syscall.GetsockoptIPv6MTUInfo(fd, syscall.IPPROTO_IPV6, soOriginalDst)
+		if err != nil {
+			return nil, fmt.Errorf("getsockopt(IP6T_SO_ORIGINAL_DST): %w", err)
+		}
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, info.Addr.Addr[:])
+		// Addr.Port is stored in network byte order; swap it back to host order.
+		port := int(info.Addr.Port>>8) | int(info.Addr.Port&0xff)<<8
+		return &net.TCPAddr{IP: ip, Port: port}, nil
+	}
+
+	raw, err := syscall.GetsockoptIPv6Mreq(fd, syscall.IPPROTO_IP, soOriginalDst)
+	if err != nil {
+		return nil, fmt.Errorf("getsockopt(SO_ORIGINAL_DST): %w", err)
+	}
+	// raw.Multiaddr holds a struct sockaddr_in: family(2) port(2, BE) addr(4).
+	b := raw.Multiaddr
+	port := int(b[2])<<8 | int(b[3])
+	ip := net.IPv4(b[4], b[5], b[6], b[7])
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
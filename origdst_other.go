@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// getOriginalDst is only implemented on Linux, where SO_ORIGINAL_DST lets us
+// recover the pre-DNAT destination of a redirected connection.
+func getOriginalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, errors.New("origdst: SO_ORIGINAL_DST is only supported on Linux")
+}
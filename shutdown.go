@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// connTracker records the live client/primary1/primary2 connections across
+// all mappings so a shutdown past its drain timeout can force-close
+// whatever handleConn goroutines haven't finished on their own.
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: make(map[net.Conn]struct{})}
+}
+
+func (t *connTracker) add(c net.Conn) {
+	t.mu.Lock()
+	t.conns[c] = struct{}{}
+	t.mu.Unlock()
+}
+
+func (t *connTracker) remove(c net.Conn) {
+	t.mu.Lock()
+	delete(t.conns, c)
+	t.mu.Unlock()
+}
+
+// closeAll force-closes every tracked connection. Used once the drain
+// timeout elapses, to unblock handleConn goroutines still copying.
+func (t *connTracker) closeAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for c := range t.conns {
+		_ = c.Close()
+	}
+}
+
+// drainOrForce waits for wg (every in-flight handleConn) to finish, up to
+// timeout, logging which way it went. If the timeout elapses first, it
+// force-closes every tracked connection via tracker and waits for wg to
+// finish unwinding.
+func drainOrForce(wg *sync.WaitGroup, tracker *connTracker, timeout time.Duration, logger Logger) {
+	drained := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		logger.Log("shutdown_drained")
+	case <-time.After(timeout):
+		logger.Log("shutdown_drain_timeout")
+		tracker.closeAll()
+		<-drained
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConnTrackerAddRemove(t *testing.T) {
+	tr := newConnTracker()
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	tr.add(c1)
+	if len(tr.conns) != 1 {
+		t.Fatalf("len(conns) = %d, want 1 after add", len(tr.conns))
+	}
+	tr.remove(c1)
+	if len(tr.conns) != 0 {
+		t.Fatalf("len(conns) = %d, want 0 after remove", len(tr.conns))
+	}
+}
+
+func TestConnTrackerCloseAllClosesTrackedConns(t *testing.T) {
+	tr := newConnTracker()
+	client, server := net.Pipe()
+	defer client.Close()
+	tr.add(server)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := server.Read(make([]byte, 1))
+		done <- err
+	}()
+
+	tr.closeAll()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatalf("Read() error = nil, want an error once closeAll closed the conn")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("closeAll did not unblock a pending Read within 1s")
+	}
+}
+
+func TestDrainOrForceReturnsOnceDrained(t *testing.T) {
+	var wg sync.WaitGroup
+	tr := newConnTracker()
+	logger := &fakeLogger{}
+
+	wg.Add(1)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		wg.Done()
+	}()
+
+	start := time.Now()
+	drainOrForce(&wg, tr, time.Second, logger)
+	if time.Since(start) >= time.Second {
+		t.Fatalf("drainOrForce waited for the full timeout, want it to return as soon as wg drained")
+	}
+	if !logger.has("shutdown_drained") {
+		t.Fatalf("events = %v, want shutdown_drained", logger.events)
+	}
+}
+
+// TestDrainOrForceClosesStuckConnPastTimeout simulates a handleConn goroutine
+// wedged on a read that only a force-close (past the drain timeout) can
+// unblock, mirroring the real shutdown path: a slow connection holds wg,
+// drainOrForce's timeout fires, tracker.closeAll() closes the conn, and the
+// stuck goroutine finally finishes wg.Done().
+func TestDrainOrForceClosesStuckConnPastTimeout(t *testing.T) {
+	var wg sync.WaitGroup
+	tr := newConnTracker()
+	logger := &fakeLogger{}
+	client, server := net.Pipe()
+	defer client.Close()
+	tr.add(server)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		server.Read(make([]byte, 1)) // blocks until closeAll closes server
+	}()
+
+	start := time.Now()
+	drainOrForce(&wg, tr, 20*time.Millisecond, logger)
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatalf("drainOrForce returned after %s, want it to wait out the drain timeout first", elapsed)
+	}
+	if !logger.has("shutdown_drain_timeout") {
+		t.Fatalf("events = %v, want shutdown_drain_timeout", logger.events)
+	}
+}
+
+func TestServeStopsAcceptingOnCtxCancel(t *testing.T) {
+	m := Mapping{Listen: "127.0.0.1:0", Primary1: "127.0.0.1:1", Primary2: "127.0.0.1:1"}
+	opts := Options{ListenerAcceptTimeout: 10 * time.Millisecond}
+	var wg sync.WaitGroup
+	tr := newConnTracker()
+	logger := &fakeLogger{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- serve(ctx, m, opts, nil, logger, &wg, tr)
+	}()
+
+	// Give serve a moment to open its listener and enter the accept loop.
+	time.Sleep(30 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatalf("serve() error = %v, want nil after ctx cancellation", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("serve() did not return within 1s of ctx cancellation")
+	}
+}
+
+type fakeLogger struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (f *fakeLogger) Log(event string, fields ...Field) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events = append(f.events, event)
+}
+
+func (f *fakeLogger) has(event string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, e := range f.events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
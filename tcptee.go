@@ -1,29 +1,84 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+
+	"github.com/serbasii/tcp-tee/metrics"
 )
 
 type Mapping struct {
 	Listen   string
 	Primary1 string // App1 - response used for client
 	Primary2 string // App2 - response discarded but required
+
+	// Primary1OrigDst, when set, means Primary1 was given as "origdst":
+	// the dial target is recovered per-connection from SO_ORIGINAL_DST
+	// instead of being fixed at startup. Lets one listener behind an
+	// iptables REDIRECT/TPROXY rule fan out arbitrary redirected flows.
+	Primary1OrigDst bool
+}
+
+// Options holds the process-wide knobs that apply to every mapping.
+type Options struct {
+	Primary2DialTimeout time.Duration
+
+	Compare           ComparatorPolicy
+	CompareSampleRate int   // max mismatch reports logged per mapping per minute
+	CompareMaxBuffer  int64 // cap on bytes buffered per leg for comparison
+
+	Primary2BufferBytes int64
+	Primary2Overflow    OverflowPolicy
+
+	ListenerAcceptTimeout time.Duration
+	DrainTimeout          time.Duration
+
+	BreakerFailureThreshold int
+	BreakerCoolDown         time.Duration
+	BreakerHalfOpenProbes   int
+	BreakerProbeInterval    time.Duration
 }
 
 func main() {
 	var mapsArg string
-	var primary2DialTimeout time.Duration
+	var opts Options
+	var compareArg string
+	var primary2Overflow string
+	var metricsAddr string
+	var logSink, logFile string
+	var logMaxSizeMB, logMaxAgeDays, logMaxBackups int
+	primary2Buffer := byteSize(4 << 20)
 
-	flag.StringVar(&mapsArg, "maps", "", `Comma-separated mappings: listen=IP:port;primary1=IP:port;primary2=IP:port`)
-	flag.DurationVar(&primary2DialTimeout, "primary2-dial-timeout", 3*time.Second, "Timeout for establishing primary2 connection")
+	flag.StringVar(&mapsArg, "maps", "", `Comma-separated mappings: listen=ADDR;primary1=ADDR;primary2=ADDR. ADDR is either a bare "host:port" (tcp) or a URL like "tls://host:port?cert=...&key=..." or "tls+sni://host:port?sni=host"; primary1 may also be "origdst" to use SO_ORIGINAL_DST (Linux only)`)
+	flag.DurationVar(&opts.Primary2DialTimeout, "primary2-dial-timeout", 3*time.Second, "Timeout for establishing primary2 connection")
+	flag.StringVar(&compareArg, "compare", "", `Compare primary2's response against primary1's: "bytes", "line", "http", or "" to disable`)
+	flag.IntVar(&opts.CompareSampleRate, "compare-sample-rate", 1, "Max mismatch reports logged per mapping per minute")
+	flag.Int64Var(&opts.CompareMaxBuffer, "compare-max-buffer", 1<<20, "Max bytes buffered per leg when -compare is set")
+	flag.Var(&primary2Buffer, "primary2-buffer", "Max bytes buffered for primary2 before its overflow policy kicks in (e.g. 4MiB)")
+	flag.StringVar(&primary2Overflow, "primary2-overflow", string(OverflowDropOldest), `Primary2 backpressure policy once its buffer is full: "block", "drop-newest", "drop-oldest", or "disconnect-sink"`)
+	flag.DurationVar(&opts.ListenerAcceptTimeout, "listener-accept-timeout", time.Second, "How often the accept loop wakes to check for shutdown")
+	flag.DurationVar(&opts.DrainTimeout, "drain-timeout", 10*time.Second, "How long to wait for in-flight connections to finish on shutdown before forcing them closed")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "Address to serve Prometheus metrics on (e.g. :9090); disabled if empty")
+	flag.StringVar(&logSink, "log-sink", "console", `Where log events go: "console", "json", or "filesystem"`)
+	flag.StringVar(&logFile, "log-file", "", "File path for -log-sink=filesystem")
+	flag.IntVar(&logMaxSizeMB, "log-max-size-mb", 100, "Max size in MiB before rotating -log-sink=filesystem's file")
+	flag.IntVar(&logMaxAgeDays, "log-max-age-days", 28, "Max age in days to retain rotated log files")
+	flag.IntVar(&logMaxBackups, "log-max-backups", 3, "Max number of rotated log files to retain")
+	flag.IntVar(&opts.BreakerFailureThreshold, "breaker-failure-threshold", 5, "Consecutive primary2 dial failures before its circuit breaker opens")
+	flag.DurationVar(&opts.BreakerCoolDown, "breaker-cooldown", 30*time.Second, "How long primary2's circuit breaker stays open before probing again")
+	flag.IntVar(&opts.BreakerHalfOpenProbes, "breaker-half-open-probes", 1, "Successful primary2 dials required while half-open before closing the breaker")
+	flag.DurationVar(&opts.BreakerProbeInterval, "breaker-probe-interval", 5*time.Second, "How often to health-probe primary2 while its breaker is open; 0 disables probing")
 	flag.Parse()
 
 	if mapsArg == "" {
@@ -31,21 +86,61 @@ func main() {
 		os.Exit(2)
 	}
 
+	policy, err := parseComparatorPolicy(compareArg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts.Compare = policy
+
+	overflow, err := parseOverflowPolicy(primary2Overflow)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts.Primary2Overflow = overflow
+	opts.Primary2BufferBytes = int64(primary2Buffer)
+
 	mappings, err := parseMappings(mapsArg)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	logger, err := parseLogSink(logSink, logFile, logMaxSizeMB, logMaxAgeDays, logMaxBackups)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	reporter := newReporter(os.Stderr, opts.CompareSampleRate)
+
+	if metricsAddr != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", metrics.Handler())
+			mux.Handle("/debug/breakers", debugBreakersHandler())
+			if err := http.ListenAndServe(metricsAddr, mux); err != nil {
+				log.Fatalf("metrics server: %v", err)
+			}
+		}()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	tracker := newConnTracker()
+	var wg sync.WaitGroup
+
 	for _, m := range mappings {
 		m := m
 		go func() {
-			if err := serve(m, primary2DialTimeout); err != nil {
+			if err := serve(ctx, m, opts, reporter, logger, &wg, tracker); err != nil {
 				log.Fatalf("listener %s: %v", m.Listen, err)
 			}
 		}()
 	}
 
-	select {} // forever
+	<-ctx.Done()
+	stop()
+	logger.Log("shutdown_begin", F("drain_timeout", opts.DrainTimeout.String()))
+	drainOrForce(&wg, tracker, opts.DrainTimeout, logger)
 }
 
 func parseMappings(s string) ([]Mapping, error) {
@@ -70,14 +165,18 @@ func parseMappings(s string) ([]Mapping, error) {
 			case "listen":
 				m.Listen = v
 			case "primary1":
-				m.Primary1 = v
+				if v == "origdst" {
+					m.Primary1OrigDst = true
+				} else {
+					m.Primary1 = v
+				}
 			case "primary2":
 				m.Primary2 = v
 			default:
 				return nil, fmt.Errorf("unknown key %q in %q", k, item)
 			}
 		}
-		if m.Listen == "" || m.Primary1 == "" || m.Primary2 == "" {
+		if m.Listen == "" || (m.Primary1 == "" && !m.Primary1OrigDst) || m.Primary2 == "" {
 			return nil, fmt.Errorf("incomplete mapping: %q", p)
 		}
 		out = append(out, m)
@@ -85,87 +184,184 @@ func parseMappings(s string) ([]Mapping, error) {
 	return out, nil
 }
 
-func serve(m Mapping, primary2DialTimeout time.Duration) error {
-	ln, err := net.Listen("tcp", m.Listen)
+func serve(ctx context.Context, m Mapping, opts Options, reporter Reporter, logger Logger, wg *sync.WaitGroup, tracker *connTracker) error {
+	ln, err := listen(m.Listen)
 	if err != nil {
 		return err
 	}
-	log.Printf("listening %s -> primary1 %s, primary2 %s", m.Listen, m.Primary1, m.Primary2)
+	tcpLn, _ := ln.(*net.TCPListener)
+
+	primary1Desc := m.Primary1
+	if m.Primary1OrigDst {
+		primary1Desc = "origdst"
+	}
+	logger.Log("listen", F("mapping", m.Listen), F("primary1", primary1Desc), F("primary2", m.Primary2))
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	go healthProbeLoop(ctx, m, opts, getBreaker(m.Listen, opts))
 
 	for {
+		if tcpLn != nil {
+			_ = tcpLn.SetDeadline(time.Now().Add(opts.ListenerAcceptTimeout))
+		}
 		c, err := ln.Accept()
 		if err != nil {
-			log.Printf("accept(%s): %v", m.Listen, err)
+			if ctx.Err() != nil {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			logger.Log("accept_error", F("mapping", m.Listen), F("error", err.Error()))
 			continue
 		}
-		go handleConn(c, m, primary2DialTimeout)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handleConn(c, m, opts, reporter, logger, tracker)
+		}()
 	}
 }
 
-func handleConn(client net.Conn, m Mapping, primary2DialTimeout time.Duration) {
+func handleConn(client net.Conn, m Mapping, opts Options, reporter Reporter, logger Logger, tracker *connTracker) {
+	clientAddr := client.RemoteAddr().String()
+	tracker.add(client)
+	defer tracker.remove(client)
 	defer client.Close()
 
+	metrics.ConnOpened(m.Listen)
+	start := time.Now()
+	defer func() {
+		metrics.ConnClosed(m.Listen)
+		metrics.ObserveHandleDuration(m.Listen, time.Since(start).Seconds())
+	}()
+
 	// Connect to Primary1 (mandatory)
-	primary1, err := net.DialTimeout("tcp", m.Primary1, 3*time.Second)
+	primary1Addr := m.Primary1
+	if m.Primary1OrigDst {
+		tcpClient, ok := client.(*net.TCPConn)
+		if !ok {
+			logger.Log("origdst_unsupported_conn", F("mapping", m.Listen), F("client_addr", clientAddr))
+			return
+		}
+		dst, err := getOriginalDst(tcpClient)
+		if err != nil {
+			logger.Log("origdst_lookup_failed", F("mapping", m.Listen), F("client_addr", clientAddr), F("error", err.Error()))
+			return
+		}
+		primary1Addr = dst.String()
+	}
+	primary1, err := dial(primary1Addr, 3*time.Second)
 	if err != nil {
-		log.Printf("[%s] primary1 dial failed: %v", m.Listen, err)
+		metrics.DialError("primary1")
+		logger.Log("primary1_dial_failed", F("mapping", m.Listen), F("client_addr", clientAddr), F("primary1", primary1Addr), F("primary2", m.Primary2), F("error", err.Error()))
 		return
 	}
+	tracker.add(primary1)
+	defer tracker.remove(primary1)
 	defer primary1.Close()
 
-	// Connect to Primary2 (mandatory)
-	primary2, err := net.DialTimeout("tcp", m.Primary2, primary2DialTimeout)
-	if err != nil {
-		log.Printf("[%s] primary2 dial failed: %v", m.Listen, err)
-		return
+	// Connect to Primary2, guarded by a per-mapping circuit breaker: once
+	// primary2 is judged unhealthy, skip dialing it entirely rather than
+	// letting its failures abort the client's request.
+	breaker := getBreaker(m.Listen, opts)
+	var primary2 net.Conn
+	primary2Target := io.Writer(io.Discard)
+	breakerWasOpen := !breaker.Allow()
+	skippingPrimary2 := breakerWasOpen
+	if !breakerWasOpen {
+		p2, err := dial(m.Primary2, opts.Primary2DialTimeout)
+		if err != nil {
+			metrics.DialError("primary2")
+			breaker.RecordResult(false)
+			logger.Log("primary2_dial_failed", F("mapping", m.Listen), F("client_addr", clientAddr), F("primary1", primary1Addr), F("primary2", m.Primary2), F("error", err.Error()))
+			skippingPrimary2 = true
+		} else {
+			breaker.RecordResult(true)
+			primary2 = p2
+			primary2Target = p2
+			tracker.add(primary2)
+			defer tracker.remove(primary2)
+			defer primary2.Close()
+		}
+	}
+	metrics.SetBreakerState(m.Listen, int(breaker.State()))
+	if breakerWasOpen {
+		logger.Log("primary2_skipped_breaker_open", F("mapping", m.Listen), F("client_addr", clientAddr), F("primary1", primary1Addr), F("primary2", m.Primary2))
+	}
+
+	var bytesUpstream int64
+	var cmp *comparison
+	if opts.Compare != ComparatorNone && !skippingPrimary2 {
+		cmp = newComparison(opts.Compare, opts.CompareMaxBuffer)
 	}
-	defer primary2.Close()
 
 	var wg sync.WaitGroup
 	wg.Add(3)
 
-	// client -> primary1 AND primary2 (both receive all data)
+	// client -> primary1 AND primary2, fanned out so a slow/overflowing
+	// primary2 does not stall the primary1 (client-facing) path, unless
+	// -primary2-overflow=block.
+	primary1Sink := newSink("primary1", primary1, 0, OverflowBlock)
+	primary2Sink := newSink("primary2", primary2Target, opts.Primary2BufferBytes, opts.Primary2Overflow)
 	go func() {
 		defer wg.Done()
-		teeCopy(primary1, primary2, client)
+		bytesUpstream = fanOutCopy(client, primary1Sink, primary2Sink)
+		metrics.BytesTransferred("upstream", "primary1", bytesUpstream)
+		if !skippingPrimary2 {
+			metrics.BytesTransferred("upstream", "primary2", bytesUpstream-primary2Sink.droppedBytes())
+		}
 		if tcp, ok := primary1.(*net.TCPConn); ok {
 			_ = tcp.CloseWrite()
 		}
 		if tcp, ok := primary2.(*net.TCPConn); ok {
 			_ = tcp.CloseWrite()
 		}
+		if dropped := primary2Sink.droppedBytes(); dropped > 0 {
+			metrics.Primary2WriteDrop(m.Listen, dropped)
+			logger.Log("primary2_bytes_dropped", F("mapping", m.Listen), F("client_addr", clientAddr), F("primary1", primary1Addr), F("primary2", m.Primary2), F("bytes", dropped), F("overflow_policy", string(opts.Primary2Overflow)))
+		}
+		if breakerWasOpen {
+			metrics.Primary2Skipped(m.Listen, bytesUpstream)
+		}
 	}()
 
 	// primary1 -> client (only primary1 response goes to client)
 	go func() {
 		defer wg.Done()
-		_, _ = io.Copy(client, primary1)
+		var n int64
+		if cmp != nil {
+			n, _ = io.Copy(io.MultiWriter(client, cmp.primary1), primary1)
+		} else {
+			n, _ = io.Copy(client, primary1)
+		}
+		metrics.BytesTransferred("downstream", "primary1", n)
 	}()
 
-	// primary2 -> discard (consume and ignore response)
+	// primary2 -> discard, or buffer for comparison (nothing to read if the
+	// circuit breaker skipped dialing primary2 for this request)
 	go func() {
 		defer wg.Done()
-		_, _ = io.Copy(io.Discard, primary2)
+		if primary2 == nil {
+			return
+		}
+		if cmp != nil {
+			_, _ = io.Copy(cmp.primary2, primary2)
+		} else {
+			_, _ = io.Copy(io.Discard, primary2)
+		}
 	}()
 
 	wg.Wait()
-}
 
-func teeCopy(primary1, primary2 io.Writer, src io.Reader) {
-	buf := make([]byte, 32*1024)
-	for {
-		n, rerr := src.Read(buf)
-		if n > 0 {
-			// Both writes must succeed
-			if _, werr := primary1.Write(buf[:n]); werr != nil {
-				return
-			}
-			if _, werr := primary2.Write(buf[:n]); werr != nil {
-				return
-			}
-		}
-		if rerr != nil {
-			return
-		}
+	if cmp != nil {
+		reporter.Report(cmp.compare(ComparisonRecord{
+			Mapping:       m.Listen,
+			ClientAddr:    clientAddr,
+			BytesUpstream: bytesUpstream,
+		}))
 	}
 }
@@ -0,0 +1,80 @@
+package main
+
+import "testing"
+
+func TestParseMappingsMultiValueALPNQueryParam(t *testing.T) {
+	s := "listen=:8080;primary1=tls://app1.internal:443?alpn=h2|http/1.1;primary2=tcp://shadow:9000"
+	mappings, err := parseMappings(s)
+	if err != nil {
+		t.Fatalf("parseMappings(%q) error: %v", s, err)
+	}
+	if len(mappings) != 1 {
+		t.Fatalf("parseMappings(%q) = %d mappings, want 1", s, len(mappings))
+	}
+	want := "tls://app1.internal:443?alpn=h2|http/1.1"
+	if got := mappings[0].Primary1; got != want {
+		t.Fatalf("Primary1 = %q, want %q", got, want)
+	}
+}
+
+func TestParseMappingsCommaInQueryValueMustBePercentEncoded(t *testing.T) {
+	// "," still separates mappings in -maps, so a literal comma inside a
+	// query value (e.g. a path) has to be percent-encoded; url.Parse (used
+	// downstream by the tls dialer) decodes it back transparently.
+	s := "listen=:8080;primary1=tls://app1.internal:443?sni=a%2Cb;primary2=tcp://shadow:9000"
+	mappings, err := parseMappings(s)
+	if err != nil {
+		t.Fatalf("parseMappings(%q) error: %v", s, err)
+	}
+	if len(mappings) != 1 {
+		t.Fatalf("parseMappings(%q) = %d mappings, want 1", s, len(mappings))
+	}
+	want := "tls://app1.internal:443?sni=a%2Cb"
+	if got := mappings[0].Primary1; got != want {
+		t.Fatalf("Primary1 = %q, want %q", got, want)
+	}
+}
+
+func TestParseMappingsPrimary1OrigDst(t *testing.T) {
+	s := "listen=:8080;primary1=origdst;primary2=tcp://shadow:9000"
+	mappings, err := parseMappings(s)
+	if err != nil {
+		t.Fatalf("parseMappings(%q) error: %v", s, err)
+	}
+	if len(mappings) != 1 {
+		t.Fatalf("parseMappings(%q) = %d mappings, want 1", s, len(mappings))
+	}
+	if !mappings[0].Primary1OrigDst {
+		t.Fatalf("Primary1OrigDst = false, want true for primary1=origdst")
+	}
+	if mappings[0].Primary1 != "" {
+		t.Fatalf("Primary1 = %q, want empty when Primary1OrigDst is set", mappings[0].Primary1)
+	}
+}
+
+func TestParseMappingsIncompleteMapping(t *testing.T) {
+	tests := []string{
+		"listen=:8080;primary2=tcp://shadow:9000",     // missing primary1
+		"listen=:8080;primary1=app1:80",               // missing primary2
+		"primary1=app1:80;primary2=tcp://shadow:9000", // missing listen
+	}
+	for _, s := range tests {
+		if _, err := parseMappings(s); err == nil {
+			t.Errorf("parseMappings(%q) error = nil, want incomplete mapping error", s)
+		}
+	}
+}
+
+func TestParseMappingsMultipleMappings(t *testing.T) {
+	s := "listen=:8080;primary1=app1:80;primary2=app2:80,listen=:8081;primary1=app3:80;primary2=app4:80"
+	mappings, err := parseMappings(s)
+	if err != nil {
+		t.Fatalf("parseMappings(%q) error: %v", s, err)
+	}
+	if len(mappings) != 2 {
+		t.Fatalf("parseMappings(%q) = %d mappings, want 2", s, len(mappings))
+	}
+	if mappings[0].Listen != ":8080" || mappings[1].Listen != ":8081" {
+		t.Fatalf("unexpected mappings: %+v", mappings)
+	}
+}
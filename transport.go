@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Dialer dials an upstream described by a URL-shaped target such as
+// "tls://app1.internal:443?sni=app1" (or a bare "host:port" for tcp).
+type Dialer func(target string, timeout time.Duration) (net.Conn, error)
+
+// ListenerFactory creates a listener for a URL-shaped listen address such as
+// "tls://:8443?cert=...&key=..." (or a bare "host:port" for tcp).
+type ListenerFactory func(target string) (net.Listener, error)
+
+var transportMu sync.RWMutex
+var dialers = map[string]Dialer{}
+var listenerFactories = map[string]ListenerFactory{}
+
+func init() {
+	RegisterDialer("tcp", dialTCP)
+	RegisterDialer("tls", dialTLS)
+	RegisterDialer("tls+sni", dialTLS)
+	RegisterListener("tcp", listenTCP)
+	RegisterListener("tls", listenTLS)
+}
+
+// RegisterDialer adds a Dialer for the given URL scheme. External code can
+// use this to add schemes (unix sockets, mTLS, SOCKS, ...) without touching
+// the tee core.
+func RegisterDialer(scheme string, d Dialer) {
+	transportMu.Lock()
+	defer transportMu.Unlock()
+	dialers[scheme] = d
+}
+
+// RegisterListener adds a ListenerFactory for the given URL scheme.
+func RegisterListener(scheme string, f ListenerFactory) {
+	transportMu.Lock()
+	defer transportMu.Unlock()
+	listenerFactories[scheme] = f
+}
+
+// schemeOf returns the URL scheme of target, defaulting to "tcp" for a bare
+// "host:port" address so existing mappings keep working unchanged.
+func schemeOf(target string) string {
+	if i := strings.Index(target, "://"); i >= 0 {
+		return target[:i]
+	}
+	return "tcp"
+}
+
+func dial(target string, timeout time.Duration) (net.Conn, error) {
+	scheme := schemeOf(target)
+	transportMu.RLock()
+	d, ok := dialers[scheme]
+	transportMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("dial: no dialer registered for scheme %q", scheme)
+	}
+	return d(target, timeout)
+}
+
+func listen(target string) (net.Listener, error) {
+	scheme := schemeOf(target)
+	transportMu.RLock()
+	f, ok := listenerFactories[scheme]
+	transportMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("listen: no listener registered for scheme %q", scheme)
+	}
+	return f(target)
+}
+
+func dialTCP(target string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", strings.TrimPrefix(target, "tcp://"), timeout)
+}
+
+func dialTLS(target string, timeout time.Duration) (net.Conn, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("dial: bad tls target %q: %w", target, err)
+	}
+	q := u.Query()
+
+	cfg := &tls.Config{ServerName: u.Hostname()}
+	if sni := q.Get("sni"); sni != "" {
+		cfg.ServerName = sni
+	}
+	cfg.NextProtos = parseALPN(q.Get("alpn"))
+	if certFile, keyFile := q.Get("cert"), q.Get("key"); certFile != "" && keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("dial: load client cert: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+	return tls.DialWithDialer(dialer, "tcp", u.Host, cfg)
+}
+
+// parseALPN splits a "?alpn=..." query value into its protocol list.
+// Protocols are separated with "|" rather than "," since "," already
+// separates mappings in -maps, and query strings routinely reach this far
+// unparsed.
+func parseALPN(raw string) []string {
+	if raw == "" {
+		return nil
+	}
+	return strings.Split(raw, "|")
+}
+
+func listenTCP(target string) (net.Listener, error) {
+	return net.Listen("tcp", strings.TrimPrefix(target, "tcp://"))
+}
+
+func listenTLS(target string) (net.Listener, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("listen: bad tls target %q: %w", target, err)
+	}
+	q := u.Query()
+
+	certFile, keyFile := q.Get("cert"), q.Get("key")
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("listen: tls:// requires cert and key query params")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("listen: load server cert: %w", err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if clientCA := q.Get("client-ca"); clientCA != "" {
+		pem, err := os.ReadFile(clientCA)
+		if err != nil {
+			return nil, fmt.Errorf("listen: read client-ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("listen: no certificates parsed from client-ca %q", clientCA)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	ln, err := net.Listen("tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(ln, cfg), nil
+}
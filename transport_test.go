@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestParseALPN(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want []string
+	}{
+		{"", nil},
+		{"h2", []string{"h2"}},
+		{"h2|http/1.1", []string{"h2", "http/1.1"}},
+	}
+	for _, tt := range tests {
+		got := parseALPN(tt.raw)
+		if len(got) != len(tt.want) {
+			t.Errorf("parseALPN(%q) = %v, want %v", tt.raw, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("parseALPN(%q) = %v, want %v", tt.raw, got, tt.want)
+				break
+			}
+		}
+	}
+}